@@ -3,11 +3,31 @@ package resource
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/weaveworks/flux/image"
 	"github.com/weaveworks/flux/resource"
 )
 
+// Annotations of this form let a chart author tell
+// FindFluxHelmReleaseContainers exactly where to find (and patch) an
+// image reference, rather than leaving it to guess at the shape of
+// `values`:
+//
+//   fluxcd.io/image.controller: controller.image.name
+//   fluxcd.io/tag.controller: controller.image.version
+//   fluxcd.io/digest.controller: controller.image.sha
+//
+// The suffix after the `.` (here, `controller`) is the container name
+// that will be reported; the value is a dotted, optionally
+// bracket-indexed, path into `Spec.Values` (e.g., `sidecars[0].image`).
+const (
+	imagePathAnnotationPrefix  = "fluxcd.io/image."
+	tagPathAnnotationPrefix    = "fluxcd.io/tag."
+	digestPathAnnotationPrefix = "fluxcd.io/digest."
+)
+
 // ReleaseContainerName is the name used when flux interprets a
 // FluxHelmRelease as having a container with an image, by virtue of
 // having a `values` stanza with an image field:
@@ -33,44 +53,166 @@ type FluxHelmRelease struct {
 
 type ImageSetter func(image.Ref)
 
+// ContainerNamePriority ranks the conventional names charts give the
+// stanza that holds their main image, most important first. It's
+// consulted, in order, when deciding how to sort the containers
+// reported by FluxHelmRelease.Containers() -- borrowed from the idea
+// behind OpenShift's PrioritizeTags, which ranks image tags by
+// matching them against a list of likely names rather than leaving
+// the order to chance. Operators can append to this list to suit
+// their own charts' conventions.
+var ContainerNamePriority = []string{
+	"image",
+	"controller",
+	"server",
+	"web",
+	"api",
+	"worker",
+}
+
+// containerPriorityIndex returns how far into ContainerNamePriority
+// name appears (lower is more important), or len(ContainerNamePriority)
+// if it doesn't appear at all.
+func containerPriorityIndex(name string) int {
+	for i, p := range ContainerNamePriority {
+		if p == name {
+			return i
+		}
+	}
+	return len(ContainerNamePriority)
+}
+
+// lessContainerKey orders two sibling keys of a values map so that a
+// key whose value is itself an image site (see hasImage) sorts before
+// one that isn't -- a key whose images are only nested further down,
+// as in a subchart stanza, counts as one that isn't; next, a key
+// matching ContainerNamePriority sorts
+// before one that doesn't, and earlier entries in the list sort before
+// later ones; and otherwise keys are ordered lexically. The lexical
+// fallback is a total order over distinct keys, so this is stable
+// across re-parses of the same document -- in particular, renaming an
+// unrelated key doesn't reshuffle the keys that do have images.
+func lessContainerKey(a string, aHasImage bool, b string, bHasImage bool) bool {
+	if aHasImage != bHasImage {
+		return aHasImage
+	}
+	if ai, bi := containerPriorityIndex(a), containerPriorityIndex(b); ai != bi {
+		return ai < bi
+	}
+	return a < b
+}
+
+// hasImage reports whether value is a map (of either kind we may find
+// in a values tree) that FindFluxHelmReleaseContainers would recognise
+// as specifying an image.
+func hasImage(value interface{}) bool {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		_, _, ok := interpret_stringmap(m)
+		return ok
+	case map[interface{}]interface{}:
+		_, _, ok := interpret_anymap(m)
+		return ok
+	}
+	return false
+}
+
 // The type we have to interpret as containers is a
-// `map[string]interface{}`; and, we want a stable order to the
-// containers we output, since things will jump around in API calls,
-// or fail to verify, otherwise. Since we can't get them in the order
-// they appear in the document, sort them.
+// `map[string]interface{}`; and, we want a meaningful, stable order to
+// the containers we output, since things will jump around in API
+// calls, or fail to verify, otherwise. Since we can't get them in the
+// order they appear in the document, sort them: see lessContainerKey.
 func sorted_keys(values map[string]interface{}) []string {
 	var keys []string
 	for k := range values {
 		keys = append(keys, k)
 	}
-	sort.Strings(keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return lessContainerKey(keys[i], hasImage(values[keys[i]]), keys[j], hasImage(values[keys[j]]))
+	})
 	return keys
 }
 
-// FindFluxHelmReleaseContainers examines the Values from a
-// FluxHelmRelease (manifest, or cluster resource, or otherwise) and
-// calls visit with each container name and image it finds, as well as
-// procedure for changing the image value. It will return an error if
-// it cannot interpret the values as specifying images, or if the
-// `visit` function itself returns an error.
-func FindFluxHelmReleaseContainers(values map[string]interface{}, visit func(string, image.Ref, ImageSetter) error) error {
+// sorted_keys_any is sorted_keys, but for the map[interface{}]interface{}
+// we get when the values (or part of them) come from YAML rather than
+// JSON. Keys are assumed to be strings, since that's the only sensible
+// kind of key for a values document to have; any other kind is ignored.
+func sorted_keys_any(values map[interface{}]interface{}) []string {
+	var keys []string
+	for k := range values {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lessContainerKey(keys[i], hasImage(values[keys[i]]), keys[j], hasImage(values[keys[j]]))
+	})
+	return keys
+}
+
+// dotted_name joins a path prefix (which may be empty, at the top of
+// the values tree) to a key, with a `.`, so that images found several
+// subchart stanzas deep are reported against a name like
+// `mysubchart.frontend`.
+func dotted_name(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// FindFluxHelmReleaseContainers examines the annotations and Values
+// from a FluxHelmRelease (manifest, or cluster resource, or otherwise)
+// and calls visit with each container name and image it finds, as well
+// as procedure for changing the image value. It returns an error only
+// when the `visit` function itself returns one; values it cannot
+// interpret as specifying images are passed over, not reported.
+//
+// If annotations naming image paths (see imagePathAnnotationPrefix,
+// above) are present, they are used in preference to the heuristics
+// below -- chart authors know their own values schema better than any
+// heuristic can guess it.
+func FindFluxHelmReleaseContainers(annotations map[string]string, values map[string]interface{}, visit func(string, image.Ref, ImageSetter) error) error {
+	if ok, err := findAnnotatedContainers(annotations, values, visit); ok {
+		return err
+	}
+
 	// Try the simplest format first:
 	// ```
 	// values:
 	//   image: 'repo/image:tag'
 	// ```
+	// An umbrella chart can have both a top-level image of its own and
+	// subcharts with their own, e.g.:
+	// ```
+	// values:
+	//   image: myapp:v1
+	//   redis:
+	//     image: bitnami/redis:6
+	// ```
+	// so report the top-level image if there is one, but don't stop
+	// there -- walk the rest of the tree too, skipping the `image` and
+	// `tag` keys since they've already been accounted for.
+	skip := map[string]bool{}
 	if image, setter, ok := interpret_stringmap(values); ok {
-		visit(ReleaseContainerName, image, setter)
-		return nil
+		if err := visit(ReleaseContainerName, image, setter); err != nil {
+			return err
+		}
+		skip["image"] = true
+		skip["tag"] = true
 	}
 
-	// Second most simple format:
+	// Walk the rest of the values tree looking for image sites at any
+	// depth, so that images embedded in subchart stanzas
+	// (`values.mysubchart.frontend.image`, and deeper still) are found
+	// just as readily as ones at the top level:
 	// ```
 	// values:
 	//   foo:
 	//     image: repo/foo:v1
-	//   bar:
-	//     image: repo/bar:v2
+	//   mysubchart:
+	//     frontend:
+	//       image: repo/frontend:v1
 	// ```
 	// with the variation that there may also be a `tag` field:
 	// ```
@@ -78,117 +220,453 @@ func FindFluxHelmReleaseContainers(values map[string]interface{}, visit func(str
 	//   foo:
 	//     image: repo/foo
 	//     tag: v1
+	// ```
+	return walk_stringmap(values, "", skip, visit)
+}
+
+// walk_stringmap and walk_anymap descend through a values tree -- which
+// may switch between `map[string]interface{}` and
+// `map[interface{}]interface{}` at any level, depending on whether that
+// part of the document came from JSON or YAML -- looking for image
+// sites, and report each one found against its dotted path. They
+// return an error as soon as `visit` does, without looking any
+// further. `skip`, only meaningful at the top of the tree, is a set of
+// keys to pass over because they've already been interpreted by the
+// caller.
+func walk_stringmap(values map[string]interface{}, prefix string, skip map[string]bool, visit func(string, image.Ref, ImageSetter) error) error {
 	for _, k := range sorted_keys(values) {
-		// From a YAML (i.e., a file), it's a
-		// `map[interface{}]interface{}`, and from JSON (i.e.,
-		// Kubernetes API) it's a `map[string]interface{}`.
+		if skip[k] {
+			continue
+		}
+		name := dotted_name(prefix, k)
 		switch m := values[k].(type) {
 		case map[string]interface{}:
 			if image, setter, ok := interpret_stringmap(m); ok {
-				visit(k, image, setter)
+				if err := visit(name, image, setter); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := walk_stringmap(m, name, nil, visit); err != nil {
+				return err
 			}
 		case map[interface{}]interface{}:
 			if image, setter, ok := interpret_anymap(m); ok {
-				visit(k, image, setter)
+				if err := visit(name, image, setter); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := walk_anymap(m, name, visit); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
 
-func interpret_stringmap(m map[string]interface{}) (image.Ref, ImageSetter, bool) {
-	switch img := m["image"].(type) {
-	case string:
-		imageRef, err := image.ParseRef(img)
-		if err == nil {
-			var taggy bool
-			if tag, ok := m["tag"]; ok {
-				if tagStr, ok := tag.(string); ok {
-					taggy = true
-					imageRef.Tag = tagStr
+// Almost exactly the same code, lexically. just a different type, because go.
+func walk_anymap(values map[interface{}]interface{}, prefix string, visit func(string, image.Ref, ImageSetter) error) error {
+	for _, k := range sorted_keys_any(values) {
+		name := dotted_name(prefix, k)
+		switch m := values[k].(type) {
+		case map[string]interface{}:
+			if image, setter, ok := interpret_stringmap(m); ok {
+				if err := visit(name, image, setter); err != nil {
+					return err
 				}
+				continue
 			}
-			return imageRef, func(ref image.Ref) {
-				if taggy {
-					m["image"] = ref.Name.String()
-					m["tag"] = ref.Tag
-					return
-				}
-				m["image"] = ref.String()
-			}, true
-		}
-	case map[string]interface{}:
-		if imgRepo, ok := img["repository"].(string); ok {
-			if imgTag, ok := img["tag"].(string); ok {
-				imgRef, err := image.ParseRef(imgRepo + ":" + imgTag)
-				if err == nil {
-					return imgRef, func(ref image.Ref) {
-						img["repository"] = ref.Name.String()
-						img["tag"] = ref.Tag
-					}, true
-				}
+			if err := walk_stringmap(m, name, nil, visit); err != nil {
+				return err
 			}
-		}
-	case map[interface{}]interface{}:
-		if imgRepo, ok := img["repository"].(string); ok {
-			if imgTag, ok := img["tag"].(string); ok {
-				imgRef, err := image.ParseRef(imgRepo + ":" + imgTag)
-				if err == nil {
-					return imgRef, func(ref image.Ref) {
-						img["repository"] = ref.Name.String()
-						img["tag"] = ref.Tag
-					}, true
+		case map[interface{}]interface{}:
+			if image, setter, ok := interpret_anymap(m); ok {
+				if err := visit(name, image, setter); err != nil {
+					return err
 				}
+				continue
+			}
+			if err := walk_anymap(m, name, visit); err != nil {
+				return err
 			}
 		}
 	}
-	return image.Ref{}, nil, false
+	return nil
+}
+
+// fieldMap abstracts over map[string]interface{} (as decoded from
+// JSON, i.e., the Kubernetes API) and map[interface{}]interface{} (as
+// decoded from YAML, i.e., a file) so that interpretImage below need
+// not be written out twice for the two types it may be asked to
+// examine.
+type fieldMap interface {
+	getString(key string) (string, bool)
+	getMap(key string) (fieldMap, bool)
+	set(key string, value interface{})
+}
+
+type stringFieldMap map[string]interface{}
+
+func (m stringFieldMap) getString(key string) (string, bool) {
+	s, ok := m[key].(string)
+	return s, ok
+}
+
+func (m stringFieldMap) getMap(key string) (fieldMap, bool) {
+	switch v := m[key].(type) {
+	case map[string]interface{}:
+		return stringFieldMap(v), true
+	case map[interface{}]interface{}:
+		return anyFieldMap(v), true
+	}
+	return nil, false
+}
+
+func (m stringFieldMap) set(key string, value interface{}) {
+	m[key] = value
+}
+
+type anyFieldMap map[interface{}]interface{}
+
+func (m anyFieldMap) getString(key string) (string, bool) {
+	s, ok := m[key].(string)
+	return s, ok
+}
+
+func (m anyFieldMap) getMap(key string) (fieldMap, bool) {
+	switch v := m[key].(type) {
+	case map[string]interface{}:
+		return stringFieldMap(v), true
+	case map[interface{}]interface{}:
+		return anyFieldMap(v), true
+	}
+	return nil, false
+}
+
+func (m anyFieldMap) set(key string, value interface{}) {
+	m[key] = value
+}
+
+func interpret_stringmap(m map[string]interface{}) (image.Ref, ImageSetter, bool) {
+	return interpretImage(stringFieldMap(m))
 }
 
 // Almost exactly the same code, lexically. just a different type, because go.
 func interpret_anymap(m map[interface{}]interface{}) (image.Ref, ImageSetter, bool) {
-	switch img := m["image"].(type) {
-	case string:
+	return interpretImage(anyFieldMap(m))
+}
+
+// interpretImage looks at the `image` entry of m, and tries each of the
+// forms it understands in turn:
+//
+//   image: repo/foo:v1
+//
+//   image: repo/foo
+//   tag: v1
+//
+//   image:
+//     repository: repo/foo
+//     tag: v1
+//     # ... and/or any of registry, digest, pullPolicy
+//
+// The last form may mix any of `registry`, `repository`, `tag` and
+// `digest`; when `registry` is given it is joined to `repository` with
+// a `/` to make the image name, and when `digest` is given the image
+// is taken to be pinned by that digest (optionally as well as a tag,
+// e.g., `myrepo/foo:v1@sha256:...`) rather than only a tag. Whichever
+// of these fields were present is exactly what gets written back by
+// the returned ImageSetter -- e.g., a `registry`+`repository` pair is
+// never collapsed into a single `image` string.
+//
+// Note that this relies on image.Ref carrying a `Digest` field and on
+// image.ParseRef accepting the `name[:tag]@digest` form; both of these
+// are assumed of the image package as of this writing and should be
+// checked against it directly rather than taken on faith.
+//
+// The `registry`+`repository` ImageSetter only round-trips cleanly when
+// the new ref's name still starts with the original `registry` value --
+// e.g., a tag or digest update on the same image. If the new ref names
+// a different registry, the old `registry` field is left as-is and the
+// full new name is folded into `repository` instead of being split back
+// out, which callers that change an image's registry need to be aware
+// of.
+func interpretImage(m fieldMap) (image.Ref, ImageSetter, bool) {
+	if img, ok := m.getString("image"); ok {
 		imageRef, err := image.ParseRef(img)
-		if err == nil {
-			var taggy bool
-			if tag, ok := m["tag"]; ok {
-				if tagStr, ok := tag.(string); ok {
-					taggy = true
-					imageRef.Tag = tagStr
-				}
+		if err != nil {
+			return image.Ref{}, nil, false
+		}
+		var taggy bool
+		if tag, ok := m.getString("tag"); ok {
+			taggy = true
+			imageRef.Tag = tag
+		}
+		return imageRef, func(ref image.Ref) {
+			if taggy {
+				m.set("image", ref.Name.String())
+				m.set("tag", ref.Tag)
+				return
 			}
-			return imageRef, func(ref image.Ref) {
-				if taggy {
-					m["image"] = ref.Name.String()
-					m["tag"] = ref.Tag
-					return
-				}
-				m["image"] = ref.String()
-			}, true
+			m.set("image", ref.String())
+		}, true
+	}
+
+	img, ok := m.getMap("image")
+	if !ok {
+		return image.Ref{}, nil, false
+	}
+
+	repository, ok := img.getString("repository")
+	if !ok {
+		return image.Ref{}, nil, false
+	}
+	registry, hasRegistry := img.getString("registry")
+	tag, hasTag := img.getString("tag")
+	digest, hasDigest := img.getString("digest")
+	if !hasTag && !hasDigest {
+		return image.Ref{}, nil, false
+	}
+
+	name := repository
+	if hasRegistry {
+		name = registry + "/" + repository
+	}
+	refString := name
+	if hasTag {
+		refString += ":" + tag
+	}
+	if hasDigest {
+		refString += "@" + digest
+	}
+
+	imageRef, err := image.ParseRef(refString)
+	if err != nil {
+		return image.Ref{}, nil, false
+	}
+
+	return imageRef, func(ref image.Ref) {
+		newRepository := ref.Name.String()
+		if hasRegistry {
+			newRepository = strings.TrimPrefix(newRepository, registry+"/")
+		}
+		img.set("repository", newRepository)
+		if hasTag {
+			img.set("tag", ref.Tag)
+		}
+		if hasDigest {
+			img.set("digest", ref.Digest)
 		}
+	}, true
+}
+
+// pathStep is one step of a dotted/bracketed path into a values tree,
+// e.g., `sidecars[0].image` is the steps `sidecars`, `[0]`, `image`.
+// Exactly one of the two fields is meaningful, according to isIndex.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseValuesPath parses a dotted, optionally bracket-indexed path of
+// the kind used in the `fluxcd.io/{image,tag,digest}.<name>`
+// annotations, e.g. `controller.image.name` or `sidecars[0].image`.
+func parseValuesPath(path string) []pathStep {
+	var steps []pathStep
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			open := strings.IndexByte(part, '[')
+			if open < 0 {
+				steps = append(steps, pathStep{key: part})
+				break
+			}
+			if open > 0 {
+				steps = append(steps, pathStep{key: part[:open]})
+			}
+			closeIdx := strings.IndexByte(part, ']')
+			if closeIdx < open {
+				break
+			}
+			if n, err := strconv.Atoi(part[open+1 : closeIdx]); err == nil {
+				steps = append(steps, pathStep{index: n, isIndex: true})
+			}
+			part = part[closeIdx+1:]
+		}
+	}
+	return steps
+}
+
+// getValuesPath resolves steps against root, which may be (nested)
+// maps of either `map[string]interface{}` or
+// `map[interface{}]interface{}`, and slices (`[]interface{}`), as
+// found when a values document is decoded from JSON or YAML.
+func getValuesPath(root interface{}, steps []pathStep) (interface{}, bool) {
+	cur := root
+	for _, step := range steps {
+		if step.isIndex {
+			s, ok := cur.([]interface{})
+			if !ok || step.index < 0 || step.index >= len(s) {
+				return nil, false
+			}
+			cur = s[step.index]
+			continue
+		}
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			v, ok := m[step.key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case map[interface{}]interface{}:
+			v, ok := m[step.key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// getValuesPathString is getValuesPath, expecting (and requiring) a
+// string at the end of the path.
+func getValuesPathString(root interface{}, steps []pathStep) (string, bool) {
+	v, ok := getValuesPath(root, steps)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// setValuesPath resolves all but the last step of steps to find the
+// containing map or slice, then sets the final key or index there to
+// value.
+func setValuesPath(root interface{}, steps []pathStep, value interface{}) bool {
+	if len(steps) == 0 {
+		return false
+	}
+	parent, ok := getValuesPath(root, steps[:len(steps)-1])
+	if !ok {
+		return false
+	}
+	last := steps[len(steps)-1]
+	if last.isIndex {
+		s, ok := parent.([]interface{})
+		if !ok || last.index < 0 || last.index >= len(s) {
+			return false
+		}
+		s[last.index] = value
+		return true
+	}
+	switch m := parent.(type) {
+	case map[string]interface{}:
+		m[last.key] = value
 	case map[interface{}]interface{}:
-		if imgRepo, ok := img["repository"].(string); ok {
-			if imgTag, ok := img["tag"].(string); ok {
-				imgRef, err := image.ParseRef(imgRepo + ":" + imgTag)
-				if err == nil {
-					return imgRef, func(ref image.Ref) {
-						img["repository"] = ref.Name.String()
-						img["tag"] = ref.Tag
-					}, true
-				}
+		m[last.key] = value
+	default:
+		return false
+	}
+	return true
+}
+
+// findAnnotatedContainers implements the annotation-driven override
+// described at imagePathAnnotationPrefix, above. It reports whether it
+// found any `fluxcd.io/image.*` annotations at all, so that
+// FindFluxHelmReleaseContainers knows whether to fall back to its
+// heuristics.
+//
+// As with interpretImage, the `fluxcd.io/digest.*` handling here assumes
+// image.ParseRef accepts a `name[:tag]@digest` string and that
+// image.Ref carries a `Digest` field -- check both against the image
+// package itself before relying on this.
+func findAnnotatedContainers(annotations map[string]string, values map[string]interface{}, visit func(string, image.Ref, ImageSetter) error) (bool, error) {
+	imagePaths := map[string]string{}
+	tagPaths := map[string]string{}
+	digestPaths := map[string]string{}
+	for k, v := range annotations {
+		switch {
+		case strings.HasPrefix(k, imagePathAnnotationPrefix):
+			imagePaths[strings.TrimPrefix(k, imagePathAnnotationPrefix)] = v
+		case strings.HasPrefix(k, tagPathAnnotationPrefix):
+			tagPaths[strings.TrimPrefix(k, tagPathAnnotationPrefix)] = v
+		case strings.HasPrefix(k, digestPathAnnotationPrefix):
+			digestPaths[strings.TrimPrefix(k, digestPathAnnotationPrefix)] = v
+		}
+	}
+	if len(imagePaths) == 0 {
+		return false, nil
+	}
+
+	var names []string
+	for name := range imagePaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		imagePath := parseValuesPath(imagePaths[name])
+		imageStr, ok := getValuesPathString(values, imagePath)
+		if !ok {
+			continue
+		}
+
+		var tagPath, digestPath []pathStep
+		hasTag, hasDigest := false, false
+		refString := imageStr
+		if p, ok := tagPaths[name]; ok {
+			if tagStr, ok := getValuesPathString(values, parseValuesPath(p)); ok {
+				tagPath, hasTag = parseValuesPath(p), true
+				refString += ":" + tagStr
 			}
 		}
+		if p, ok := digestPaths[name]; ok {
+			if digestStr, ok := getValuesPathString(values, parseValuesPath(p)); ok {
+				digestPath, hasDigest = parseValuesPath(p), true
+				refString += "@" + digestStr
+			}
+		}
+
+		ref, err := image.ParseRef(refString)
+		if err != nil {
+			continue
+		}
+
+		setter := func(ref image.Ref) {
+			if hasTag || hasDigest {
+				setValuesPath(values, imagePath, ref.Name.String())
+			} else {
+				setValuesPath(values, imagePath, ref.String())
+			}
+			if hasTag {
+				setValuesPath(values, tagPath, ref.Tag)
+			}
+			if hasDigest {
+				setValuesPath(values, digestPath, ref.Digest)
+			}
+		}
+
+		if err := visit(name, ref, setter); err != nil {
+			return true, err
+		}
 	}
-	return image.Ref{}, nil, false
+	return true, nil
 }
 
 // Containers returns the containers that are defined in the
-// FluxHelmRelease.
+// FluxHelmRelease. Containers found by the heuristics are ordered per
+// ContainerNamePriority (see lessContainerKey) rather than plain
+// alphabetical order, after the top-level ReleaseContainerName image if
+// there is one; containers named by annotations are reported in
+// alphabetical order of their names.
 func (fhr FluxHelmRelease) Containers() []resource.Container {
 	var containers []resource.Container
 	// If there's an error in interpreting, return what we have.
-	_ = FindFluxHelmReleaseContainers(fhr.Spec.Values, func(container string, image image.Ref, _ ImageSetter) error {
+	_ = FindFluxHelmReleaseContainers(fhr.Meta.Annotations, fhr.Spec.Values, func(container string, image image.Ref, _ ImageSetter) error {
 		containers = append(containers, resource.Container{
 			Name:  container,
 			Image: image,
@@ -204,7 +682,7 @@ func (fhr FluxHelmRelease) Containers() []resource.Container {
 // get away with a value-typed receiver because we set a map entry.
 func (fhr FluxHelmRelease) SetContainerImage(container string, ref image.Ref) error {
 	found := false
-	if err := FindFluxHelmReleaseContainers(fhr.Spec.Values, func(name string, image image.Ref, setter ImageSetter) error {
+	if err := FindFluxHelmReleaseContainers(fhr.Meta.Annotations, fhr.Spec.Values, func(name string, image image.Ref, setter ImageSetter) error {
 		if container == name {
 			setter(ref)
 			found = true
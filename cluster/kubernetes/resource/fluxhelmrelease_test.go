@@ -1,8 +1,11 @@
 package resource
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
+	"github.com/weaveworks/flux/image"
 	"github.com/weaveworks/flux/resource"
 )
 
@@ -365,3 +368,593 @@ spec:
 		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
 	}
 }
+
+func TestParseNestedSubchartImageFormat(t *testing.T) {
+	expectedContainer := "mysubchart.frontend"
+	expectedImage := "bitnami/frontend:1.2.3"
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    mysubchart:
+      frontend:
+        image: ` + expectedImage + `
+      persistence:
+        enabled: false
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+
+	newImage := containers[0].Image.WithNewTag("some-other-tag")
+	if err := fhr.SetContainerImage(expectedContainer, newImage); err != nil {
+		t.Error(err)
+	}
+
+	containers = fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image = containers[0].Image.String()
+	if image != newImage.String() {
+		t.Errorf("expected container image %q, got %q", newImage.String(), image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+}
+
+// TestFindNestedSubchartImagesMixedMapTypes exercises
+// FindFluxHelmReleaseContainers directly, with a values tree that
+// switches between map[string]interface{} and
+// map[interface{}]interface{} across and within levels of nesting --
+// which can happen when part of the tree originates from JSON (the
+// Kubernetes API) and part from YAML (chart defaults merged in), or
+// simply because a subchart's values were decoded separately from its
+// parent's.
+func TestFindNestedSubchartImagesMixedMapTypes(t *testing.T) {
+	values := map[string]interface{}{
+		"mysubchart": map[interface{}]interface{}{
+			"frontend": map[string]interface{}{
+				"image": "bitnami/frontend:1.2.3",
+			},
+			"backend": map[interface{}]interface{}{
+				"image": "bitnami/backend:4.5.6",
+			},
+		},
+	}
+
+	found := map[string]string{}
+	err := FindFluxHelmReleaseContainers(nil, values, func(name string, img image.Ref, _ ImageSetter) error {
+		found[name] = img.String()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "bitnami/frontend:1.2.3"; found["mysubchart.frontend"] != expected {
+		t.Errorf("expected mysubchart.frontend to be %q, got %#v", expected, found)
+	}
+	if expected := "bitnami/backend:4.5.6"; found["mysubchart.backend"] != expected {
+		t.Errorf("expected mysubchart.backend to be %q, got %#v", expected, found)
+	}
+}
+
+func TestParseNamedImageDigestOnlyFormat(t *testing.T) {
+	expectedContainer := "db"
+	expectedImageName := "bitnami/mariadb"
+	expectedDigest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b85"
+	expectedImage := expectedImageName + "@" + expectedDigest
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    ` + expectedContainer + `:
+      image:
+        repository: ` + expectedImageName + `
+        digest: ` + expectedDigest + `
+      persistence:
+        enabled: false
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+}
+
+func TestParseNamedImageRegistryFormat(t *testing.T) {
+	expectedContainer := "db"
+	expectedRegistry := "gcr.io"
+	expectedRepository := "my-project/mariadb"
+	expectedImageTag := "10.1.30-r1"
+	expectedImage := expectedRegistry + "/" + expectedRepository + ":" + expectedImageTag
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    ` + expectedContainer + `:
+      image:
+        registry: ` + expectedRegistry + `
+        repository: ` + expectedRepository + `
+        tag: ` + expectedImageTag + `
+      persistence:
+        enabled: false
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+
+	newImage := containers[0].Image.WithNewTag("some-other-tag")
+	if err := fhr.SetContainerImage(expectedContainer, newImage); err != nil {
+		t.Error(err)
+	}
+
+	containers = fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image = containers[0].Image.String()
+	if image != newImage.String() {
+		t.Errorf("expected container image %q, got %q", newImage.String(), image)
+	}
+
+	// Re-deriving the image string from Containers() would pass even if
+	// SetContainerImage had collapsed registry/repository/tag back into
+	// a single `image` string, so check the values tree itself to make
+	// sure the four-field structure survived the write.
+	var values map[string]interface{}
+	switch v := res.(type) {
+	case *FluxHelmRelease:
+		values = v.Spec.Values
+	case FluxHelmRelease:
+		values = v.Spec.Values
+	default:
+		t.Fatalf("expected *FluxHelmRelease or FluxHelmRelease, got %#v", res)
+	}
+
+	newRegistry, ok := getValuesPathString(values, parseValuesPath(expectedContainer+".image.registry"))
+	if !ok || newRegistry != expectedRegistry {
+		t.Errorf("expected registry %q to be untouched, got %q (present: %v)", expectedRegistry, newRegistry, ok)
+	}
+	newRepository, ok := getValuesPathString(values, parseValuesPath(expectedContainer+".image.repository"))
+	if !ok || newRepository != expectedRepository {
+		t.Errorf("expected repository %q to be untouched, got %q (present: %v)", expectedRepository, newRepository, ok)
+	}
+	newTag, ok := getValuesPathString(values, parseValuesPath(expectedContainer+".image.tag"))
+	if !ok || newTag != "some-other-tag" {
+		t.Errorf("expected tag %q, got %q (present: %v)", "some-other-tag", newTag, ok)
+	}
+}
+
+func TestParseNamedImageTagAndDigestFormat(t *testing.T) {
+	expectedContainer := "db"
+	expectedImageName := "bitnami/mariadb"
+	expectedImageTag := "10.1.30-r1"
+	expectedDigest := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b85"
+	expectedImage := expectedImageName + ":" + expectedImageTag + "@" + expectedDigest
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    ` + expectedContainer + `:
+      image:
+        repository: ` + expectedImageName + `
+        tag: ` + expectedImageTag + `
+        digest: ` + expectedDigest + `
+      persistence:
+        enabled: false
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+}
+
+func TestParseAnnotatedImagePath(t *testing.T) {
+	expectedContainer := "controller"
+	expectedImageName := "quay.io/example/controller"
+	expectedImageTag := "v2.3.4"
+	expectedImage := expectedImageName + ":" + expectedImageTag
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+  annotations:
+    fluxcd.io/image.controller: controller.image.name
+    fluxcd.io/tag.controller: controller.image.version
+spec:
+  chartGitPath: mariadb
+  values:
+    controller:
+      image:
+        name: ` + expectedImageName + `
+        version: ` + expectedImageTag + `
+      replicas: 2
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+
+	newImage := containers[0].Image.WithNewTag("v2.3.5")
+	if err := fhr.SetContainerImage(expectedContainer, newImage); err != nil {
+		t.Error(err)
+	}
+
+	containers = fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image = containers[0].Image.String()
+	if image != newImage.String() {
+		t.Errorf("expected container image %q, got %q", newImage.String(), image)
+	}
+}
+
+func TestParseAnnotatedImagePathArrayIndex(t *testing.T) {
+	expectedContainer := "sidecar0"
+	expectedImage := "quay.io/example/sidecar:v1.0.0"
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+  annotations:
+    fluxcd.io/image.sidecar0: sidecars[0].image
+spec:
+  chartGitPath: mariadb
+  values:
+    sidecars:
+    - image: ` + expectedImage + `
+    - image: quay.io/example/other:v1.0.0
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+}
+
+func TestParseFallsBackToHeuristicsWithoutAnnotations(t *testing.T) {
+	expectedContainer := "db"
+	expectedImage := "bitnami/mariadb:10.1.30-r1"
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    ` + expectedContainer + `:
+      image: ` + expectedImage + `
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 1 {
+		t.Fatalf("expected 1 container; got %#v", containers)
+	}
+	image := containers[0].Image.String()
+	if image != expectedImage {
+		t.Errorf("expected container image %q, got %q", expectedImage, image)
+	}
+	if containers[0].Name != expectedContainer {
+		t.Errorf("expected container name %q, got %q", expectedContainer, containers[0].Name)
+	}
+}
+
+func TestContainerOrderingPriority(t *testing.T) {
+	values := map[string]interface{}{
+		"worker": map[string]interface{}{"image": "repo/worker:v1"},
+		"api":    map[string]interface{}{"image": "repo/api:v1"},
+		"zzz":    map[string]interface{}{"image": "repo/zzz:v1"},
+		"aaa":    map[string]interface{}{"image": "repo/aaa:v1"},
+		"other":  map[string]interface{}{"enabled": false},
+	}
+
+	var names []string
+	err := FindFluxHelmReleaseContainers(nil, values, func(name string, _ image.Ref, _ ImageSetter) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"api", "worker", "aaa", "zzz"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected order %#v, got %#v", expected, names)
+	}
+}
+
+// TestContainerOrderingStableAcrossRename demonstrates that renaming a
+// key that has nothing to do with containers doesn't shuffle where the
+// containers that do have images end up.
+func TestContainerOrderingStableAcrossRename(t *testing.T) {
+	order := func(values map[string]interface{}) []string {
+		var names []string
+		if err := FindFluxHelmReleaseContainers(nil, values, func(name string, _ image.Ref, _ ImageSetter) error {
+			names = append(names, name)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+
+	before := order(map[string]interface{}{
+		"api":                 map[string]interface{}{"image": "repo/api:v1"},
+		"worker":              map[string]interface{}{"image": "repo/worker:v1"},
+		"some-unrelated-name": map[string]interface{}{"enabled": false},
+	})
+	after := order(map[string]interface{}{
+		"api":                     map[string]interface{}{"image": "repo/api:v1"},
+		"worker":                  map[string]interface{}{"image": "repo/worker:v1"},
+		"totally-different-label": map[string]interface{}{"enabled": false},
+	})
+
+	if len(before) != 2 || before[0] != "api" || before[1] != "worker" {
+		t.Fatalf("expected [api worker] to lead, got %#v", before)
+	}
+	if len(after) != 2 || after[0] != "api" || after[1] != "worker" {
+		t.Fatalf("expected [api worker] to still lead after rename, got %#v", after)
+	}
+}
+
+// TestParseTopLevelImagePlusSubchart locks in that an umbrella chart's
+// own top-level image doesn't stop FindFluxHelmReleaseContainers from
+// also finding images in subchart stanzas alongside it.
+func TestParseTopLevelImagePlusSubchart(t *testing.T) {
+	expectedTopImage := "myorg/myapp:v1"
+	expectedSubImage := "bitnami/redis:6"
+
+	doc := `---
+apiVersion: helm.integrations.flux.weave.works/v1alpha2
+kind: FluxHelmRelease
+metadata:
+  name: mariadb
+  namespace: maria
+  labels:
+    chart: mariadb
+spec:
+  chartGitPath: mariadb
+  values:
+    image: ` + expectedTopImage + `
+    redis:
+      image: ` + expectedSubImage + `
+`
+
+	resources, err := ParseMultidoc([]byte(doc), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := resources["maria:fluxhelmrelease/mariadb"]
+	if !ok {
+		t.Fatalf("expected resource not found; instead got %#v", resources)
+	}
+	fhr, ok := res.(resource.Workload)
+	if !ok {
+		t.Fatalf("expected resource to be a Workload, instead got %#v", res)
+	}
+
+	containers := fhr.Containers()
+	if len(containers) != 2 {
+		t.Fatalf("expected 2 containers; got %#v", containers)
+	}
+
+	found := map[string]string{}
+	for _, c := range containers {
+		found[c.Name] = c.Image.String()
+	}
+	if found[ReleaseContainerName] != expectedTopImage {
+		t.Errorf("expected %s to be %q, got %#v", ReleaseContainerName, expectedTopImage, found)
+	}
+	if found["redis"] != expectedSubImage {
+		t.Errorf("expected redis to be %q, got %#v", expectedSubImage, found)
+	}
+}
+
+// TestFindFluxHelmReleaseContainersPropagatesVisitError checks that an
+// error returned by visit during the heuristic walk is propagated,
+// just as findAnnotatedContainers already does for the annotation-driven
+// path.
+func TestFindFluxHelmReleaseContainersPropagatesVisitError(t *testing.T) {
+	values := map[string]interface{}{
+		"foo": map[string]interface{}{"image": "repo/foo:v1"},
+		"bar": map[string]interface{}{"image": "repo/bar:v1"},
+	}
+
+	wantErr := fmt.Errorf("boom")
+	err := FindFluxHelmReleaseContainers(nil, values, func(name string, _ image.Ref, _ ImageSetter) error {
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("expected visit's error to be propagated, got %v", err)
+	}
+}